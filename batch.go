@@ -0,0 +1,243 @@
+// Copyright 2017 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package ctmap
+
+import "crypto/subtle"
+
+// batchOp identifies the kind of operation recorded in a Batch entry.
+type batchOp int
+
+const (
+	batchSet batchOp = iota
+	batchReplace
+	batchRename
+	batchDelete
+)
+
+// batchEntry records a single queued operation. key2 is only used by
+// Replace and Rename, val is only used by Set and Replace.
+type batchEntry struct {
+	op        batchOp
+	key, key2 []byte
+	val       []byte
+}
+
+// Batch records a sequence of Set, Replace, Rename and delete-mark
+// operations to be applied to a Map in a single call to Map.Apply.
+//
+// Applying a Batch of N operations against a Map with len(m) entries
+// takes two linear passes over the map's backing storage, one for
+// Set, Replace and Rename and one for delete-marks, rather than the N
+// separate passes that calling Set, Replace, Rename and Delete
+// individually would require. It does not do it in one pass.
+//
+// If a Batch contains more than one Set, Replace or Rename for the
+// same key, the last one appended wins; earlier operations touching
+// that key are shadowed, matching the order in which they were
+// recorded. A delete-mark for a key removes it wherever it was
+// appended, see Map.Apply.
+//
+// The zero value of Batch is an empty batch ready to use.
+type Batch struct {
+	ops []batchEntry
+}
+
+// Set queues a Set operation, see Map.Set. key and val are copied, so
+// they may be reused or modified after Set returns.
+func (b *Batch) Set(key, val []byte) {
+	b.ops = append(b.ops, batchEntry{
+		op:  batchSet,
+		key: append([]byte(nil), key...),
+		val: append([]byte(nil), val...),
+	})
+}
+
+// Replace queues a Replace operation, see Map.Replace. oldKey, newKey
+// and val are copied, so they may be reused or modified after Replace
+// returns.
+func (b *Batch) Replace(oldKey, newKey, val []byte) {
+	b.ops = append(b.ops, batchEntry{
+		op:   batchReplace,
+		key:  append([]byte(nil), oldKey...),
+		key2: append([]byte(nil), newKey...),
+		val:  append([]byte(nil), val...),
+	})
+}
+
+// Rename queues a Rename operation, see Map.Rename. oldKey and newKey
+// are copied, so they may be reused or modified after Rename returns.
+func (b *Batch) Rename(oldKey, newKey []byte) {
+	b.ops = append(b.ops, batchEntry{
+		op:   batchRename,
+		key:  append([]byte(nil), oldKey...),
+		key2: append([]byte(nil), newKey...),
+	})
+}
+
+// Delete queues a delete-mark operation, see Map.Delete. key is
+// copied, so it may be reused or modified after Delete returns.
+func (b *Batch) Delete(key []byte) {
+	b.ops = append(b.ops, batchEntry{op: batchDelete, key: append([]byte(nil), key...)})
+}
+
+// Len returns the number of operations queued in the batch.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Reset clears the batch so that it can be reused.
+func (b *Batch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// Apply executes all of the operations queued in batch against m in
+// two passes over m's backing storage. It returns the number of
+// entries removed by delete-mark operations in batch.
+//
+// Set, Replace and Rename operations are applied to every entry in
+// m using the same subtle.ConstantTimeCompare/ConstantTimeCopy
+// primitives as their single-operation counterparts, so which keys
+// in batch matched an entry is not leaked. Among these, queued
+// operations are considered in the order they were appended, so
+// later operations take precedence over earlier ones for the same
+// key, without branching on key contents. If m was created with
+// NewWithTombstones, a soft-deleted entry is walked like any other
+// entry but these operations will not match it and will not
+// resurrect it, as Map.Set does. Unlike Map.Set, Map.Replace and
+// Map.Rename, every matching entry is updated, not only the first.
+//
+// Delete-mark operations are applied afterwards, in a second pass.
+// Because this pass always runs last, queuing a delete-mark for a
+// key removes it regardless of where in the batch the delete-mark
+// was appended relative to any Set, Replace or Rename for that same
+// key. Unlike Map.SoftDelete and Map.Delete, every entry matching a
+// delete-mark is affected, not only the first. If m was created with
+// NewWithTombstones, this pass marks matching live entries deleted as
+// Map.SoftDelete does, and does not change the size of the map.
+// Otherwise it physically removes matching entries and zeroes the
+// vacated entries at the end of the backing storage, keeping its
+// capacity, and is subject to the same WARNING documented on
+// Map.Delete:
+// the resulting size of the map, and therefore the time taken by
+// future calls, depends on how many entries were removed.
+//
+// Apply panics if any operation queued in batch has a key, oldKey,
+// newKey or val whose length does not match m's keySize or valSize,
+// the same as calling the corresponding single-operation method
+// directly would.
+func (m *Map) Apply(batch *Batch) int {
+	for _, op := range batch.ops {
+		switch op.op {
+		case batchSet:
+			if len(op.key) != m.keySize {
+				panic("key has invalid size")
+			}
+			if len(op.val) != m.valSize {
+				panic("val has invalid size")
+			}
+		case batchReplace:
+			if len(op.key) != m.keySize {
+				panic("oldKey has invalid size")
+			}
+			if len(op.key2) != m.keySize {
+				panic("newKey has invalid size")
+			}
+			if len(op.val) != m.valSize {
+				panic("val has invalid size")
+			}
+		case batchRename:
+			if len(op.key) != m.keySize {
+				panic("oldKey has invalid size")
+			}
+			if len(op.key2) != m.keySize {
+				panic("newKey has invalid size")
+			}
+		case batchDelete:
+			if len(op.key) != m.keySize {
+				panic("key has invalid size")
+			}
+		}
+	}
+
+	off := m.validOffset()
+
+	for _, entry := range m.m {
+		live := 1
+		if m.tombstones {
+			live = subtle.ConstantTimeByteEq(entry[off], 1)
+		}
+
+		for _, op := range batch.ops {
+			switch op.op {
+			case batchSet:
+				vv := subtle.ConstantTimeCompare(entry[:m.keySize], op.key) & live
+				subtle.ConstantTimeCopy(vv, entry[m.keySize:m.keySize+m.valSize], op.val)
+			case batchReplace:
+				vv := subtle.ConstantTimeCompare(entry[:m.keySize], op.key) & live
+				subtle.ConstantTimeCopy(vv, entry[:m.keySize], op.key2)
+				subtle.ConstantTimeCopy(vv, entry[m.keySize:m.keySize+m.valSize], op.val)
+			case batchRename:
+				vv := subtle.ConstantTimeCompare(entry[:m.keySize], op.key) & live
+				subtle.ConstantTimeCopy(vv, entry[:m.keySize], op.key2)
+			}
+		}
+	}
+
+	if m.tombstones {
+		var removed int
+
+		for _, entry := range m.m {
+			live := subtle.ConstantTimeByteEq(entry[off], 1)
+
+			var del int
+			for _, op := range batch.ops {
+				if op.op == batchDelete {
+					del |= subtle.ConstantTimeCompare(entry[:m.keySize], op.key)
+				}
+			}
+			del &= live
+
+			entry[off] = byte(subtle.ConstantTimeSelect(del, 0, int(entry[off])))
+			removed += del
+		}
+
+		return removed
+	}
+
+	n := len(m.m)
+	dst := 0
+
+	for src := 0; src < n; src++ {
+		entry := m.m[src]
+
+		var del int
+		for _, op := range batch.ops {
+			if op.op == batchDelete {
+				del |= subtle.ConstantTimeCompare(entry[:m.keySize], op.key)
+			}
+		}
+
+		if del == 1 {
+			continue
+		}
+
+		copy(m.m[dst], entry)
+		dst++
+	}
+
+	removed := n - dst
+
+	for i := dst; i < n; i++ {
+		entry := m.m[i]
+		for j := range entry {
+			entry[j] = 0
+		}
+	}
+
+	m.m = m.m[:dst:cap(m.m)]
+
+	return removed
+}
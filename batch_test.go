@@ -0,0 +1,236 @@
+// Copyright 2017 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package ctmap
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBatchLen(t *testing.T) {
+	var b Batch
+
+	if l := b.Len(); l != 0 {
+		t.Error("Len failed")
+		t.Logf("expected: %d", 0)
+		t.Logf("got:      %d", l)
+		t.Fatal()
+	}
+
+	b.Set([]byte{0xa5}, []byte{0x5a})
+	b.Delete([]byte{0x5a})
+
+	if l := b.Len(); l != 2 {
+		t.Error("Len failed")
+		t.Logf("expected: %d", 2)
+		t.Logf("got:      %d", l)
+		t.Fatal()
+	}
+
+	b.Reset()
+
+	if l := b.Len(); l != 0 {
+		t.Error("Reset failed to clear batch")
+		t.Logf("expected: %d", 0)
+		t.Logf("got:      %d", l)
+		t.Fatal()
+	}
+}
+
+func TestApply(t *testing.T) {
+	for _, c := range []struct {
+		before  [][]byte
+		batch   func(b *Batch)
+		after   [][]byte
+		removed int
+	}{
+		{nil, func(b *Batch) {}, nil, 0},
+		{
+			[][]byte{{0xa5, 0x5a}},
+			func(b *Batch) { b.Set([]byte{0xa5}, []byte{0xff}) },
+			[][]byte{{0xa5, 0xff}},
+			0,
+		},
+		{
+			[][]byte{{0xa5, 0x5a}, {0x5a, 0xa5}},
+			func(b *Batch) {
+				b.Set([]byte{0xa5}, []byte{0x11})
+				b.Set([]byte{0x5a}, []byte{0x22})
+			},
+			[][]byte{{0xa5, 0x11}, {0x5a, 0x22}},
+			0,
+		},
+		{
+			// last op for a key wins
+			[][]byte{{0xa5, 0x5a}},
+			func(b *Batch) {
+				b.Set([]byte{0xa5}, []byte{0x11})
+				b.Set([]byte{0xa5}, []byte{0x22})
+			},
+			[][]byte{{0xa5, 0x22}},
+			0,
+		},
+		{
+			[][]byte{{0xa5, 0x5a}},
+			func(b *Batch) { b.Replace([]byte{0xa5}, []byte{0x5a}, []byte{0xff}) },
+			[][]byte{{0x5a, 0xff}},
+			0,
+		},
+		{
+			[][]byte{{0xa5, 0x5a}},
+			func(b *Batch) { b.Rename([]byte{0xa5}, []byte{0x5a}) },
+			[][]byte{{0x5a, 0x5a}},
+			0,
+		},
+		{
+			[][]byte{{0xa5, 0x5a}, {0x5a, 0xa5}},
+			func(b *Batch) { b.Delete([]byte{0xa5}) },
+			[][]byte{{0x5a, 0xa5}},
+			1,
+		},
+		{
+			[][]byte{{0xa5, 0x5a}, {0x5a, 0xa5}, {0x11, 0x22}},
+			func(b *Batch) {
+				b.Delete([]byte{0xa5})
+				b.Delete([]byte{0x11})
+			},
+			[][]byte{{0x5a, 0xa5}},
+			2,
+		},
+		{
+			// delete-marks always win over a Set for the same key,
+			// regardless of queuing order.
+			[][]byte{{0xa5, 0x5a}},
+			func(b *Batch) {
+				b.Set([]byte{0xa5}, []byte{0xff})
+				b.Delete([]byte{0xa5})
+			},
+			[][]byte{},
+			1,
+		},
+	} {
+		var before [][]byte
+		if c.before != nil {
+			before = make([][]byte, len(c.before))
+			for i, entry := range c.before {
+				before[i] = append([]byte(nil), entry...)
+			}
+		}
+
+		m := &Map{m: before, keySize: 1, valSize: 1}
+
+		var b Batch
+		c.batch(&b)
+
+		removed := m.Apply(&b)
+
+		if removed != c.removed || !reflect.DeepEqual(m.m, c.after) {
+			t.Error("Apply failed")
+			t.Logf("expected: %02x, %d", c.after, c.removed)
+			t.Logf("got:      %02x, %d", m.m, removed)
+			t.Fatal()
+		}
+	}
+}
+
+func TestApplyWithTombstones(t *testing.T) {
+	m := NewWithTombstones(1, 1)
+	m.Add([]byte{0xa5}, []byte{0x5a})
+	m.Add([]byte{0x5a}, []byte{0xa5})
+
+	var b Batch
+	b.Delete([]byte{0xa5})
+	b.Set([]byte{0x5a}, []byte{0xff})
+
+	if removed := m.Apply(&b); removed != 1 {
+		t.Error("Apply failed")
+		t.Logf("expected removed: %d", 1)
+		t.Logf("got removed:      %d", removed)
+		t.Fatal()
+	}
+
+	// the deleted entry must still be present in the backing
+	// storage, merely tombstoned, not physically removed.
+	if l := len(m.m); l != 2 {
+		t.Error("Apply physically removed an entry on a tombstoned map")
+		t.Logf("expected len(m.m): %d", 2)
+		t.Logf("got len(m.m):      %d", l)
+		t.Fatal()
+	}
+
+	if v := m.Contains([]byte{0xa5}); v != 0 {
+		t.Error("Apply failed to soft-delete a5")
+	}
+
+	var val [1]byte
+	if v := m.Lookup([]byte{0x5a}, val[:]); v != 1 || val[0] != 0xff {
+		t.Error("Apply failed to update a live entry")
+		t.Logf("expected: 0xff, 1")
+		t.Logf("got:      0x%02x, %d", val[0], v)
+		t.Fatal()
+	}
+
+	// a batch must not be able to resurrect a soft-deleted entry.
+	var b2 Batch
+	b2.Set([]byte{0xa5}, []byte{0x11})
+
+	if m.Apply(&b2) != 0 {
+		t.Error("Apply resurrected a soft-deleted entry")
+	}
+
+	if v := m.Contains([]byte{0xa5}); v != 0 {
+		t.Error("Apply resurrected a soft-deleted entry")
+	}
+}
+
+func TestBatchCopiesOperands(t *testing.T) {
+	key := []byte{0xa5}
+	val := []byte{0x5a}
+
+	var b Batch
+	b.Set(key, val)
+
+	key[0] = 0xff
+	val[0] = 0xff
+
+	m := &Map{m: [][]byte{{0xa5, 0x11}}, keySize: 1, valSize: 1}
+	m.Apply(&b)
+
+	if got := m.m[0]; got[0] != 0xa5 || got[1] != 0x5a {
+		t.Error("Batch.Set did not copy its operands")
+		t.Logf("expected: %02x", [2]byte{0xa5, 0x5a})
+		t.Logf("got:      %02x", got)
+	}
+}
+
+func TestApplyPanicsOnInvalidSize(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		batch func(b *Batch)
+	}{
+		{"Set key", func(b *Batch) { b.Set([]byte{0xa5, 0xa5}, []byte{0x5a}) }},
+		{"Set val", func(b *Batch) { b.Set([]byte{0xa5}, []byte{0x5a, 0x5a}) }},
+		{"Replace oldKey", func(b *Batch) { b.Replace([]byte{0xa5, 0xa5}, []byte{0x5a}, []byte{0x5a}) }},
+		{"Replace newKey", func(b *Batch) { b.Replace([]byte{0xa5}, []byte{0x5a, 0x5a}, []byte{0x5a}) }},
+		{"Replace val", func(b *Batch) { b.Replace([]byte{0xa5}, []byte{0x5a}, []byte{0x5a, 0x5a}) }},
+		{"Rename oldKey", func(b *Batch) { b.Rename([]byte{0xa5, 0xa5}, []byte{0x5a}) }},
+		{"Rename newKey", func(b *Batch) { b.Rename([]byte{0xa5}, []byte{0x5a, 0x5a}) }},
+		{"Delete key", func(b *Batch) { b.Delete([]byte{0xa5, 0xa5}) }},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Apply did not panic on an invalid %s size", c.name)
+				}
+			}()
+
+			var b Batch
+			c.batch(&b)
+
+			(&Map{m: [][]byte{{0xa5, 0x5a}}, keySize: 1, valSize: 1}).Apply(&b)
+		}()
+	}
+}
@@ -13,6 +13,11 @@ type Map struct {
 	m [][]byte
 
 	keySize, valSize int
+
+	// tombstones, when set, reserves one extra byte at the end of
+	// every entry to record whether it is live (1) or soft-deleted
+	// (0), see NewWithTombstones.
+	tombstones bool
 }
 
 // New returns a new constant-time map with the
@@ -47,10 +52,68 @@ func NewWithCapacity(keySize, valSize, capacity int) *Map {
 	}
 }
 
+// NewWithTombstones returns a new constant-time map with the given
+// key and value sizes, in which SoftDelete is used instead of Delete
+// to remove entries.
+//
+// Deleting an entry with Delete leaks whether the delete succeeded,
+// because the map's size, and therefore the time taken by other
+// methods, changes immediately. A map returned by NewWithTombstones
+// instead marks deleted entries with a per-entry validity flag, in
+// the same way etcd's mvcc package treats removed keys as tombstoned
+// revisions rather than erasing them. Len, Contains, Lookup, Set and
+// Range all continue to walk every entry, live or not, and mask
+// their result using the validity flag, so a caller cannot tell a
+// soft-deleted key from one that was never present by timing. Use
+// Compact to reclaim the space used by tombstones once it is safe to
+// leak how many entries were removed.
+//
+// Every key and value must be of equal size.
+//
+// For a constant-time equivalent of map[string]struct{},
+// use 0 for valSize.
+func NewWithTombstones(keySize, valSize int) *Map {
+	return &Map{
+		keySize:    keySize,
+		valSize:    valSize,
+		tombstones: true,
+	}
+}
+
+// entrySize returns the size of a single backing entry, including
+// the trailing validity byte reserved by NewWithTombstones.
+func (m *Map) entrySize() int {
+	if m.tombstones {
+		return m.keySize + m.valSize + 1
+	}
+
+	return m.keySize + m.valSize
+}
+
+// validOffset returns the offset of the validity byte within an
+// entry. It is only meaningful when m.tombstones is set.
+func (m *Map) validOffset() int {
+	return m.keySize + m.valSize
+}
+
 // Len returns the number of entries in the map. It does
 // not account for duplicates.
+//
+// If m was created with NewWithTombstones, soft-deleted entries are
+// walked but not counted.
 func (m *Map) Len() int {
-	return len(m.m)
+	if !m.tombstones {
+		return len(m.m)
+	}
+
+	off := m.validOffset()
+
+	var n int
+	for _, entry := range m.m {
+		n += subtle.ConstantTimeByteEq(entry[off], 1)
+	}
+
+	return n
 }
 
 // Add appends a new entry to the map. It does not check
@@ -64,9 +127,13 @@ func (m *Map) Add(key, val []byte) {
 		panic("val has invalid size")
 	}
 
-	entry := make([]byte, m.keySize+m.valSize)
+	entry := make([]byte, m.entrySize())
 	copy(entry[:m.keySize], key)
-	copy(entry[m.keySize:], val)
+	copy(entry[m.keySize:m.keySize+m.valSize], val)
+
+	if m.tombstones {
+		entry[m.validOffset()] = 1
+	}
 
 	m.m = append(m.m, entry)
 }
@@ -77,6 +144,10 @@ func (m *Map) Add(key, val []byte) {
 //
 // If there are multiple entries with the same key, only
 // the first entry will have it's value set to val.
+//
+// If m was created with NewWithTombstones, a soft-deleted entry is
+// treated as absent: it is walked like any other entry but Set will
+// not match it and will not resurrect it.
 func (m *Map) Set(key, val []byte) int {
 	if len(key) != m.keySize {
 		panic("key has invalid size")
@@ -86,11 +157,16 @@ func (m *Map) Set(key, val []byte) int {
 		panic("val has invalid size")
 	}
 
+	off := m.validOffset()
+
 	var v int
 
 	for _, entry := range m.m {
 		vv := subtle.ConstantTimeCompare(entry[:m.keySize], key) &^ v
-		subtle.ConstantTimeCopy(vv, entry[m.keySize:], val)
+		if m.tombstones {
+			vv &= subtle.ConstantTimeByteEq(entry[off], 1)
+		}
+		subtle.ConstantTimeCopy(vv, entry[m.keySize:m.keySize+m.valSize], val)
 		v |= vv
 	}
 
@@ -121,7 +197,7 @@ func (m *Map) Replace(oldKey, newKey, val []byte) int {
 	for _, entry := range m.m {
 		vv := subtle.ConstantTimeCompare(entry[:m.keySize], oldKey) &^ v
 		subtle.ConstantTimeCopy(vv, entry[:m.keySize], newKey)
-		subtle.ConstantTimeCopy(vv, entry[m.keySize:], val)
+		subtle.ConstantTimeCopy(vv, entry[m.keySize:m.keySize+m.valSize], val)
 		v |= vv
 	}
 
@@ -156,15 +232,24 @@ func (m *Map) Rename(oldKey, newKey []byte) int {
 // Contains determines if a key is present in the map in
 // constant-time. It returns 1 if the key is present, 0
 // otherwise.
+//
+// If m was created with NewWithTombstones, a soft-deleted entry is
+// walked like any other entry but never counted as present.
 func (m *Map) Contains(key []byte) int {
 	if len(key) != m.keySize {
 		panic("key has invalid size")
 	}
 
+	off := m.validOffset()
+
 	var v int
 
 	for _, entry := range m.m {
-		v |= subtle.ConstantTimeCompare(entry[:m.keySize], key)
+		c := subtle.ConstantTimeCompare(entry[:m.keySize], key)
+		if m.tombstones {
+			c &= subtle.ConstantTimeByteEq(entry[off], 1)
+		}
+		v |= c
 	}
 
 	return v
@@ -177,6 +262,11 @@ func (m *Map) Contains(key []byte) int {
 //
 // If there are multiple entries matching key, only the
 // first will be returned.
+//
+// If m was created with NewWithTombstones, a soft-deleted entry is
+// walked like any other entry but Lookup will not match it, so a
+// caller cannot distinguish a soft-deleted key from one that was
+// never present.
 func (m *Map) Lookup(key, val []byte) int {
 	if len(key) != m.keySize {
 		panic("key has invalid size")
@@ -186,11 +276,16 @@ func (m *Map) Lookup(key, val []byte) int {
 		panic("val has invalid size")
 	}
 
+	off := m.validOffset()
+
 	var v int
 
 	for _, entry := range m.m {
 		vv := subtle.ConstantTimeCompare(entry[:m.keySize], key) &^ v
-		subtle.ConstantTimeCopy(vv, val, entry[m.keySize:])
+		if m.tombstones {
+			vv &= subtle.ConstantTimeByteEq(entry[off], 1)
+		}
+		subtle.ConstantTimeCopy(vv, val, entry[m.keySize:m.keySize+m.valSize])
 		v |= vv
 	}
 
@@ -265,8 +360,90 @@ func (m *Map) Delete(key []byte) int {
 //
 // The behaviour of the map is undefined if key or val are
 // modified.
+//
+// If m was created with NewWithTombstones, every entry, live or
+// soft-deleted, is walked, but f is only called for live entries.
 func (m *Map) Range(f func(key, val []byte)) {
+	off := m.validOffset()
+
 	for _, entry := range m.m {
-		f(entry[:m.keySize], entry[m.valSize:])
+		if m.tombstones && entry[off] == 0 {
+			continue
+		}
+
+		f(entry[:m.keySize], entry[m.keySize:m.keySize+m.valSize])
 	}
 }
+
+// SoftDelete marks an entry with a given key as deleted without
+// removing it from the map's backing storage, unlike Delete. It
+// returns 1 if a live entry was found and marked deleted, 0
+// otherwise. SoftDelete panics if m was not created with
+// NewWithTombstones.
+//
+// If the map contains multiple entries with the same key, only the
+// first live one is marked deleted.
+//
+// Unlike Delete, SoftDelete does not change the size of the map, nor
+// the time taken by other methods, so it does not leak whether the
+// key was present. Call Compact to reclaim the space used by
+// soft-deleted entries once it is safe to leak how many there are.
+func (m *Map) SoftDelete(key []byte) int {
+	if !m.tombstones {
+		panic("map was not created with NewWithTombstones")
+	}
+
+	if len(key) != m.keySize {
+		panic("key has invalid size")
+	}
+
+	off := m.validOffset()
+
+	var v int
+
+	for _, entry := range m.m {
+		live := subtle.ConstantTimeByteEq(entry[off], 1)
+		vv := subtle.ConstantTimeCompare(entry[:m.keySize], key) & live &^ v
+		entry[off] = byte(subtle.ConstantTimeSelect(vv, 0, int(entry[off])))
+		v |= vv
+	}
+
+	return v
+}
+
+// Compact permanently removes every soft-deleted entry from m,
+// reclaiming its space, and zeroes the vacated storage.
+//
+// Unlike the rest of this package, Compact is NOT constant-time: its
+// running time, and the resulting size of the map, depend on how
+// many entries were soft-deleted. It is intended to be called only
+// at a point where that is safe to leak, such as an epoch rollover,
+// not interleaved with operations that must remain constant-time.
+//
+// Compact is a no-op on a map not created with NewWithTombstones.
+func (m *Map) Compact() {
+	if !m.tombstones {
+		return
+	}
+
+	off := m.validOffset()
+	n := len(m.m)
+	dst := 0
+
+	for src := 0; src < n; src++ {
+		entry := m.m[src]
+
+		if entry[off] == 0 {
+			for i := range entry {
+				entry[i] = 0
+			}
+
+			continue
+		}
+
+		m.m[dst] = entry
+		dst++
+	}
+
+	m.m = m.m[:dst:cap(m.m)]
+}
@@ -0,0 +1,235 @@
+// Copyright 2017 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package ctmap
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+// headerSize is the size, in bytes, of the fixed-layout header
+// written by WriteTo: a keySize, a valSize and a number of entries,
+// each a fixed-width big-endian integer, followed by a one byte
+// flags field.
+const headerSize = 4 + 4 + 8 + 1
+
+// flagTombstones is set in a header's flags byte when the encoded
+// map was created with NewWithTombstones, meaning every entry in the
+// blob carries a trailing validity byte.
+const flagTombstones = 1 << 0
+
+// ErrSchemaMismatch is returned by UnmarshalBinary, ReadFrom and
+// LoadFromFile when a blob's declared keySize or valSize does not
+// match the Map being decoded into. Rejecting the blob rather than
+// adopting its declared sizes lets a caller pin the keySize/valSize
+// it expects to load.
+var ErrSchemaMismatch = errors.New("ctmap: blob schema does not match map")
+
+// ErrMACMismatch is returned by LoadFromFile when a file's trailing
+// MAC does not match its payload, for example because the file was
+// tampered with or the wrong key was supplied.
+var ErrMACMismatch = errors.New("ctmap: MAC does not match payload")
+
+// MarshalBinary encodes m's entries into a single fixed-layout blob:
+// a header of keySize, valSize, the number of entries and a flags
+// byte, each a fixed-width big-endian integer, followed by that many
+// entries in insertion order. Encoding touches every entry in the
+// same order regardless of its contents, so encoding time does not
+// depend on any key or value.
+//
+// If m was created with NewWithTombstones, every entry, live or
+// soft-deleted, is encoded, including its validity byte, so a
+// soft-deleted entry round-trips as soft-deleted and the blob's size
+// does not leak how many entries were removed.
+func (m *Map) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary replaces m's contents by decoding a blob previously
+// produced by MarshalBinary or WriteTo. It returns ErrSchemaMismatch
+// if the blob's declared keySize or valSize does not match m's.
+func (m *Map) UnmarshalBinary(data []byte) error {
+	_, err := m.ReadFrom(bytes.NewReader(data))
+	return err
+}
+
+// WriteTo writes m's binary encoding, as described on MarshalBinary,
+// to w and returns the number of bytes written.
+func (m *Map) WriteTo(w io.Writer) (int64, error) {
+	entrySize := m.entrySize()
+
+	var flags byte
+	if m.tombstones {
+		flags |= flagTombstones
+	}
+
+	var header [headerSize]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(m.keySize))
+	binary.BigEndian.PutUint32(header[4:8], uint32(m.valSize))
+	binary.BigEndian.PutUint64(header[8:16], uint64(len(m.m)))
+	header[16] = flags
+
+	n, err := w.Write(header[:])
+	total := int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	for _, entry := range m.m {
+		n, err := w.Write(entry[:entrySize])
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+
+	return total, nil
+}
+
+// ReadFrom replaces m's contents by decoding a blob previously
+// written by WriteTo or MarshalBinary from r, and returns the number
+// of bytes read. It returns ErrSchemaMismatch if the blob's declared
+// keySize or valSize does not match m's, or if the blob's flags
+// disagree with whether m was created with NewWithTombstones, so a
+// caller always gets the schema it expects rather than silently
+// adopting whatever the blob claims.
+//
+// If m was created with NewWithTombstones, every entry, live or
+// soft-deleted, is restored exactly as encoded.
+func (m *Map) ReadFrom(r io.Reader) (int64, error) {
+	var header [headerSize]byte
+
+	n, err := io.ReadFull(r, header[:])
+	total := int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	keySize := int(binary.BigEndian.Uint32(header[0:4]))
+	valSize := int(binary.BigEndian.Uint32(header[4:8]))
+	count := binary.BigEndian.Uint64(header[8:16])
+	tombstones := header[16]&flagTombstones != 0
+
+	if keySize != m.keySize || valSize != m.valSize || tombstones != m.tombstones {
+		return total, ErrSchemaMismatch
+	}
+
+	entrySize := m.entrySize()
+	payload := make([]byte, entrySize)
+
+	var entries [][]byte
+	for i := uint64(0); i < count; i++ {
+		n, err := io.ReadFull(r, payload)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+
+		entry := make([]byte, entrySize)
+		copy(entry, payload)
+
+		entries = append(entries, entry)
+	}
+
+	m.m = entries
+
+	return total, nil
+}
+
+// MAC computes an HMAC-SHA256, keyed with key, over m's encoding as
+// produced by MarshalBinary. The result can be stored alongside the
+// encoded blob and checked later with Verify.
+func (m *Map) MAC(key []byte) ([]byte, error) {
+	data, err := m.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil), nil
+}
+
+// Verify reports, in constant-time, whether mac is the HMAC-SHA256,
+// keyed with key, of m's current encoding, as produced by MAC.
+func (m *Map) Verify(key, mac []byte) (bool, error) {
+	expected, err := m.MAC(key)
+	if err != nil {
+		return false, err
+	}
+
+	return subtle.ConstantTimeCompare(expected, mac) == 1, nil
+}
+
+// SaveToFile writes m's binary encoding, followed by an HMAC-SHA256
+// of that encoding keyed with macKey, to a new file at name. It
+// fails if name already exists, using O_EXCL semantics, so that
+// persisting a token table across restarts cannot silently clobber
+// an existing one.
+func (m *Map) SaveToFile(name string, macKey []byte) error {
+	data, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	h := hmac.New(sha256.New, macKey)
+	h.Write(data)
+
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	if _, err := f.Write(h.Sum(nil)); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// LoadFromFile replaces m's contents by decoding a file previously
+// written by SaveToFile at name, verifying its trailing HMAC-SHA256
+// against macKey before accepting any entries. It returns
+// ErrMACMismatch if the MAC does not match, and ErrSchemaMismatch if
+// the file's declared keySize or valSize does not match m's,
+// letting a caller pin the keySize/valSize it expects to load.
+func (m *Map) LoadFromFile(name string, macKey []byte) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+
+	if len(data) < sha256.Size {
+		return ErrMACMismatch
+	}
+
+	payload, mac := data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+
+	h := hmac.New(sha256.New, macKey)
+	h.Write(payload)
+
+	if subtle.ConstantTimeCompare(h.Sum(nil), mac) != 1 {
+		return ErrMACMismatch
+	}
+
+	return m.UnmarshalBinary(payload)
+}
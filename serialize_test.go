@@ -0,0 +1,165 @@
+// Copyright 2017 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package ctmap
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMarshalUnmarshalBinary(t *testing.T) {
+	m := &Map{m: [][]byte{{0xa5, 0x5a}, {0x5a, 0xa5}}, keySize: 1, valSize: 1}
+
+	data, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m2 := New(1, 1)
+	if err := m2.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(m.m, m2.m) {
+		t.Error("UnmarshalBinary failed to round-trip entries")
+		t.Logf("expected: %02x", m.m)
+		t.Logf("got:      %02x", m2.m)
+		t.Fatal()
+	}
+}
+
+func TestUnmarshalBinarySchemaMismatch(t *testing.T) {
+	m := &Map{m: [][]byte{{0xa5, 0x5a}}, keySize: 1, valSize: 1}
+
+	data, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := New(2, 1).UnmarshalBinary(data); err != ErrSchemaMismatch {
+		t.Error("UnmarshalBinary failed to reject mismatched keySize")
+		t.Logf("expected: %v", ErrSchemaMismatch)
+		t.Logf("got:      %v", err)
+		t.Fatal()
+	}
+}
+
+func TestMarshalBinaryPreservesTombstones(t *testing.T) {
+	m := NewWithTombstones(1, 1)
+	m.Add([]byte{0xa5}, []byte{0x5a})
+	m.Add([]byte{0x5a}, []byte{0xa5})
+	m.SoftDelete([]byte{0xa5})
+
+	data, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m2 := NewWithTombstones(1, 1)
+	if err := m2.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+
+	// the soft-deleted entry must still be present in the backing
+	// storage, so the blob's size does not leak how many entries
+	// were removed.
+	if l := len(m2.m); l != 2 {
+		t.Error("UnmarshalBinary dropped the soft-deleted entry")
+		t.Logf("expected len(m.m): %d", 2)
+		t.Logf("got len(m.m):      %d", l)
+		t.Fatal()
+	}
+
+	if l := m2.Len(); l != 1 {
+		t.Error("UnmarshalBinary failed to preserve tombstone state")
+		t.Logf("expected len: %d", 1)
+		t.Logf("got len:      %d", l)
+		t.Fatal()
+	}
+
+	if v := m2.Contains([]byte{0xa5}); v != 0 {
+		t.Error("UnmarshalBinary resurrected a soft-deleted entry")
+	}
+}
+
+func TestUnmarshalBinaryTombstoneSchemaMismatch(t *testing.T) {
+	m := NewWithTombstones(1, 1)
+	m.Add([]byte{0xa5}, []byte{0x5a})
+
+	data, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := New(1, 1).UnmarshalBinary(data); err != ErrSchemaMismatch {
+		t.Error("UnmarshalBinary failed to reject a tombstoned blob into a plain map")
+		t.Logf("expected: %v", ErrSchemaMismatch)
+		t.Logf("got:      %v", err)
+		t.Fatal()
+	}
+}
+
+func TestVerify(t *testing.T) {
+	m := &Map{m: [][]byte{{0xa5, 0x5a}}, keySize: 1, valSize: 1}
+	key := []byte("hmac-key")
+
+	mac, err := m.MAC(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := m.Verify(key, mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Error("Verify rejected a genuine MAC")
+	}
+
+	mac[0] ^= 0xff
+	ok, err = m.Verify(key, mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("Verify accepted a tampered MAC")
+	}
+}
+
+func TestSaveLoadFile(t *testing.T) {
+	m := &Map{m: [][]byte{{0xa5, 0x5a}, {0x5a, 0xa5}}, keySize: 1, valSize: 1}
+	key := []byte("hmac-key")
+
+	name := filepath.Join(t.TempDir(), "table")
+
+	if err := m.SaveToFile(name, key); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SaveToFile(name, key); err == nil {
+		t.Error("SaveToFile overwrote an existing file")
+	}
+
+	m2 := New(1, 1)
+	if err := m2.LoadFromFile(name, key); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(m.m, m2.m) {
+		t.Error("LoadFromFile failed to round-trip entries")
+		t.Logf("expected: %02x", m.m)
+		t.Logf("got:      %02x", m2.m)
+		t.Fatal()
+	}
+
+	if err := m2.LoadFromFile(name, []byte("wrong-key")); err != ErrMACMismatch {
+		t.Error("LoadFromFile failed to reject a wrong MAC key")
+		t.Logf("expected: %v", ErrMACMismatch)
+		t.Logf("got:      %v", err)
+		t.Fatal()
+	}
+}
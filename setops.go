@@ -0,0 +1,95 @@
+// Copyright 2017 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package ctmap
+
+// ConflictPolicy selects which value wins when Merge encounters a
+// key present in both maps.
+type ConflictPolicy int
+
+const (
+	// KeepExisting keeps m's existing value for a key present in
+	// both maps, discarding other's value for that key.
+	KeepExisting ConflictPolicy = iota
+
+	// TakeIncoming overwrites m's existing value with other's value
+	// for a key present in both maps.
+	TakeIncoming
+)
+
+// Merge copies every entry of other into m: a key not already
+// present in m is inserted, and a key already present is resolved
+// according to onConflict. It returns the number of keys that were
+// already present in m.
+//
+// This lets a caller compose token/permission tables, a common
+// pattern when merging per-tenant caches, in one call instead of a
+// Range over other plus per-key Contains/Set/Add calls.
+//
+// m.Add is called for every entry in other, regardless of onConflict
+// or whether the key already existed in m, relying on Map's tolerance
+// of duplicate keys and its first-match-wins read semantics: for
+// TakeIncoming the pre-existing entry has already been updated in
+// place by Set, and for KeepExisting it is left untouched, so the
+// newly appended entry is always redundant when a key already
+// existed. This keeps m's growth, and so the time taken by later
+// calls, fixed at len(other) regardless of how many keys collided.
+func (m *Map) Merge(other *Map, onConflict ConflictPolicy) int {
+	var existing int
+
+	other.Range(func(key, val []byte) {
+		switch onConflict {
+		case TakeIncoming:
+			existing += m.Set(key, val)
+		case KeepExisting:
+			existing += m.Contains(key)
+		}
+
+		m.Add(key, val)
+	})
+
+	return existing
+}
+
+// Intersect returns a new Map containing the entries of m whose key
+// is also present in other. The returned Map has the same keySize
+// and valSize as m.
+//
+// WARNING: like Delete, Intersect leaks timing information. The
+// returned Map's size, and therefore the time taken by other methods
+// in this package, is exactly the number of keys m and other have in
+// common, because result.Add is only called for a shared key.
+func (m *Map) Intersect(other *Map) *Map {
+	result := NewWithCapacity(m.keySize, m.valSize, m.Len())
+
+	m.Range(func(key, val []byte) {
+		if other.Contains(key) == 1 {
+			result.Add(key, val)
+		}
+	})
+
+	return result
+}
+
+// Difference returns a new Map containing the entries of m whose key
+// is not present in other. The returned Map has the same keySize and
+// valSize as m.
+//
+// WARNING: like Delete, Difference leaks timing information. The
+// returned Map's size, and therefore the time taken by other methods
+// in this package, is exactly the number of keys in m that are not in
+// other, because result.Add is only called for a key that is not
+// shared.
+func (m *Map) Difference(other *Map) *Map {
+	result := NewWithCapacity(m.keySize, m.valSize, m.Len())
+
+	m.Range(func(key, val []byte) {
+		if other.Contains(key) == 0 {
+			result.Add(key, val)
+		}
+	})
+
+	return result
+}
@@ -0,0 +1,95 @@
+// Copyright 2017 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package ctmap
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	for _, c := range []struct {
+		before   [][]byte
+		other    [][]byte
+		policy   ConflictPolicy
+		after    [][]byte
+		existing int
+	}{
+		{
+			nil,
+			[][]byte{{0xa5, 0x5a}},
+			TakeIncoming,
+			[][]byte{{0xa5, 0x5a}},
+			0,
+		},
+		{
+			// a colliding key is updated in place by Set, but Add
+			// still appends an extra, redundant copy: Merge never
+			// branches on whether a key collided.
+			[][]byte{{0xa5, 0x5a}},
+			[][]byte{{0xa5, 0xff}},
+			TakeIncoming,
+			[][]byte{{0xa5, 0xff}, {0xa5, 0xff}},
+			1,
+		},
+		{
+			[][]byte{{0xa5, 0x5a}},
+			[][]byte{{0xa5, 0xff}},
+			KeepExisting,
+			[][]byte{{0xa5, 0x5a}, {0xa5, 0xff}},
+			1,
+		},
+		{
+			[][]byte{{0xa5, 0x5a}},
+			[][]byte{{0xa5, 0xff}, {0x5a, 0x11}},
+			TakeIncoming,
+			[][]byte{{0xa5, 0xff}, {0xa5, 0xff}, {0x5a, 0x11}},
+			1,
+		},
+	} {
+		m := &Map{m: c.before, keySize: 1, valSize: 1}
+		other := &Map{m: c.other, keySize: 1, valSize: 1}
+
+		existing := m.Merge(other, c.policy)
+
+		if existing != c.existing || !reflect.DeepEqual(m.m, c.after) {
+			t.Error("Merge failed")
+			t.Logf("expected: %02x, %d", c.after, c.existing)
+			t.Logf("got:      %02x, %d", m.m, existing)
+			t.Fatal()
+		}
+	}
+}
+
+func TestIntersect(t *testing.T) {
+	m := &Map{m: [][]byte{{0xa5, 0x5a}, {0x5a, 0xa5}, {0x11, 0x22}}, keySize: 1, valSize: 1}
+	other := &Map{m: [][]byte{{0xa5, 0xff}, {0x11, 0xff}}, keySize: 1, valSize: 1}
+
+	got := m.Intersect(other)
+
+	want := [][]byte{{0xa5, 0x5a}, {0x11, 0x22}}
+	if !reflect.DeepEqual(got.m, want) {
+		t.Error("Intersect failed")
+		t.Logf("expected: %02x", want)
+		t.Logf("got:      %02x", got.m)
+		t.Fatal()
+	}
+}
+
+func TestDifference(t *testing.T) {
+	m := &Map{m: [][]byte{{0xa5, 0x5a}, {0x5a, 0xa5}, {0x11, 0x22}}, keySize: 1, valSize: 1}
+	other := &Map{m: [][]byte{{0xa5, 0xff}, {0x11, 0xff}}, keySize: 1, valSize: 1}
+
+	got := m.Difference(other)
+
+	want := [][]byte{{0x5a, 0xa5}}
+	if !reflect.DeepEqual(got.m, want) {
+		t.Error("Difference failed")
+		t.Logf("expected: %02x", want)
+		t.Logf("got:      %02x", got.m)
+		t.Fatal()
+	}
+}
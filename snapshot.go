@@ -0,0 +1,328 @@
+// Copyright 2017 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package ctmap
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"math/rand"
+)
+
+// treapNode is an immutable node in a persistent treap, ordered by
+// key using bytes.Compare and balanced using a random priority. Once
+// constructed a treapNode is never mutated; With and Without build
+// new nodes along the affected path and share the rest of the tree
+// with the snapshot they were derived from.
+type treapNode struct {
+	key, val []byte
+	priority int64
+
+	left, right *treapNode
+}
+
+// Snapshot is an immutable, versioned view of a Map's entries, backed
+// by a persistent treap. Unlike copying a Map, deriving a new
+// Snapshot with With or Without is cheap: the new Snapshot shares
+// every node of the old one except those on the path to the changed
+// key, similar to the approach gopls uses for its snapshot layer.
+// This makes Snapshot suitable for rollback, MVCC, or for reasoning
+// about a fixed view of a map while other code continues to mutate
+// it, without paying an O(n) copy on every change.
+//
+// The treap's key order decides where With and Without graft new
+// nodes and the order in which Range and Clone visit entries; it is
+// never used to prune a search. Lookup and Contains always walk every node
+// in the snapshot and compare every key with
+// subtle.ConstantTimeCompare, so the benefit of the treap is cheap
+// versioning, not faster lookups.
+//
+// WARNING: With and Without are NOT constant-time, unlike Lookup and
+// Contains. This is a deliberate scoping of this package's
+// constant-time guarantee, not an oversight: finding where to graft a
+// new node requires comparing keys with bytes.Compare to walk down to
+// the right path, so the time With and Without take, and the shape of
+// the resulting tree, depend on key contents and on a key's order
+// relative to the rest of the snapshot. Doing that walk with
+// subtle.ConstantTimeCompare instead would mean visiting every node
+// on every With/Without, which is exactly the O(n)-per-change cost
+// this type exists to avoid; a persistent tree cannot have cheap
+// structural updates and side-channel-free ones at the same time.
+// Map.Snapshot is not constant-time either: it inserts every entry
+// with the same bytes.Compare walk as With, and skips soft-deleted and
+// duplicate entries by branching on them. Only Lookup and Contains
+// are constant-time.
+type Snapshot struct {
+	root             *treapNode
+	keySize, valSize int
+	len              int
+}
+
+// Snapshot captures the current contents of m as an immutable
+// Snapshot. Later changes to m do not affect the returned Snapshot.
+//
+// If m was created with NewWithTombstones, soft-deleted entries are
+// not included in the snapshot.
+//
+// If m contains duplicate keys, only the first entry for a key is
+// included in the snapshot, matching Lookup, Set and Contains.
+func (m *Map) Snapshot() *Snapshot {
+	s := &Snapshot{keySize: m.keySize, valSize: m.valSize}
+
+	off := m.validOffset()
+	seen := make(map[string]bool, len(m.m))
+
+	for _, entry := range m.m {
+		if m.tombstones && entry[off] == 0 {
+			continue
+		}
+
+		k := string(entry[:m.keySize])
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+
+		key := append([]byte(nil), entry[:m.keySize]...)
+		val := append([]byte(nil), entry[m.keySize:m.keySize+m.valSize]...)
+
+		root, grew := treapInsert(s.root, key, val, rand.Int63())
+		s.root = root
+		if grew {
+			s.len++
+		}
+	}
+
+	return s
+}
+
+// Len returns the number of entries in the snapshot.
+func (s *Snapshot) Len() int {
+	return s.len
+}
+
+// Contains determines if a key is present in the snapshot in
+// constant-time. It returns 1 if the key is present, 0 otherwise.
+func (s *Snapshot) Contains(key []byte) int {
+	if len(key) != s.keySize {
+		panic("key has invalid size")
+	}
+
+	var v int
+
+	walkTreap(s.root, func(n *treapNode) {
+		v |= subtle.ConstantTimeCompare(n.key, key)
+	})
+
+	return v
+}
+
+// Lookup finds the value associated with a key in the snapshot in
+// constant-time. The value is copied, in constant-time, into val
+// which must be the correct length. It returns 1 if the key was
+// present, 0 otherwise.
+func (s *Snapshot) Lookup(key, val []byte) int {
+	if len(key) != s.keySize {
+		panic("key has invalid size")
+	}
+
+	if len(val) != s.valSize {
+		panic("val has invalid size")
+	}
+
+	var v int
+
+	walkTreap(s.root, func(n *treapNode) {
+		vv := subtle.ConstantTimeCompare(n.key, key) &^ v
+		subtle.ConstantTimeCopy(vv, val, n.val)
+		v |= vv
+	})
+
+	return v
+}
+
+// With returns a new Snapshot with key set to val, leaving s
+// unmodified. If key is not already present in s it is inserted,
+// otherwise its value is replaced. The new Snapshot shares every
+// node of s's tree other than those on the path to key.
+//
+// WARNING: With is not constant-time, see Snapshot.
+func (s *Snapshot) With(key, val []byte) *Snapshot {
+	if len(key) != s.keySize {
+		panic("key has invalid size")
+	}
+
+	if len(val) != s.valSize {
+		panic("val has invalid size")
+	}
+
+	key = append([]byte(nil), key...)
+	val = append([]byte(nil), val...)
+
+	root, grew := treapInsert(s.root, key, val, rand.Int63())
+
+	ns := &Snapshot{root: root, keySize: s.keySize, valSize: s.valSize, len: s.len}
+	if grew {
+		ns.len++
+	}
+
+	return ns
+}
+
+// Without returns a new Snapshot with key removed, leaving s
+// unmodified. If key is not present in s, Without returns a Snapshot
+// equivalent to s. The new Snapshot shares every node of s's tree
+// other than those on the path to key.
+//
+// WARNING: Without is not constant-time, see Snapshot.
+func (s *Snapshot) Without(key []byte) *Snapshot {
+	if len(key) != s.keySize {
+		panic("key has invalid size")
+	}
+
+	root, shrank := treapDelete(s.root, key)
+
+	ns := &Snapshot{root: root, keySize: s.keySize, valSize: s.valSize, len: s.len}
+	if shrank {
+		ns.len--
+	}
+
+	return ns
+}
+
+// Clone returns a new, independent, mutable Map containing the same
+// entries as s, analogous to maps.Clone. The returned Map's backing
+// entries share a single contiguous allocation, built in O(n) by
+// walking s's tree once.
+func (s *Snapshot) Clone() *Map {
+	m := &Map{keySize: s.keySize, valSize: s.valSize}
+
+	if s.len == 0 {
+		return m
+	}
+
+	entrySize := s.keySize + s.valSize
+	backing := make([]byte, s.len*entrySize)
+	m.m = make([][]byte, 0, s.len)
+
+	i := 0
+	walkTreap(s.root, func(n *treapNode) {
+		entry := backing[i*entrySize : (i+1)*entrySize : (i+1)*entrySize]
+		copy(entry[:s.keySize], n.key)
+		copy(entry[s.keySize:], n.val)
+		m.m = append(m.m, entry)
+		i++
+	})
+
+	return m
+}
+
+// Range calls f for each entry in the snapshot, in key order.
+//
+// The behaviour of the snapshot is undefined if key or val are
+// modified.
+func (s *Snapshot) Range(f func(key, val []byte)) {
+	walkTreap(s.root, func(n *treapNode) {
+		f(n.key, n.val)
+	})
+}
+
+// walkTreap calls f for every node in n's subtree, in key order.
+func walkTreap(n *treapNode, f func(n *treapNode)) {
+	if n == nil {
+		return
+	}
+
+	walkTreap(n.left, f)
+	f(n)
+	walkTreap(n.right, f)
+}
+
+// treapInsert returns a persistent treap equivalent to n with key
+// set to val, sharing every node of n other than those on the path
+// to key. It reports whether the entry was newly inserted, as
+// opposed to replacing an existing entry for key.
+func treapInsert(n *treapNode, key, val []byte, priority int64) (*treapNode, bool) {
+	if n == nil {
+		return &treapNode{key: key, val: val, priority: priority}, true
+	}
+
+	switch c := bytes.Compare(key, n.key); {
+	case c == 0:
+		return &treapNode{key: n.key, val: val, priority: n.priority, left: n.left, right: n.right}, false
+	case c < 0:
+		left, grew := treapInsert(n.left, key, val, priority)
+		nn := &treapNode{key: n.key, val: n.val, priority: n.priority, left: left, right: n.right}
+		if left.priority > nn.priority {
+			nn = rotateRight(nn)
+		}
+		return nn, grew
+	default:
+		right, grew := treapInsert(n.right, key, val, priority)
+		nn := &treapNode{key: n.key, val: n.val, priority: n.priority, left: n.left, right: right}
+		if right.priority > nn.priority {
+			nn = rotateLeft(nn)
+		}
+		return nn, grew
+	}
+}
+
+// treapDelete returns a persistent treap equivalent to n with key
+// removed, sharing every node of n other than those on the path to
+// key. It reports whether an entry was removed.
+func treapDelete(n *treapNode, key []byte) (*treapNode, bool) {
+	if n == nil {
+		return nil, false
+	}
+
+	switch c := bytes.Compare(key, n.key); {
+	case c == 0:
+		return treapMerge(n.left, n.right), true
+	case c < 0:
+		left, shrank := treapDelete(n.left, key)
+		if !shrank {
+			return n, false
+		}
+		return &treapNode{key: n.key, val: n.val, priority: n.priority, left: left, right: n.right}, true
+	default:
+		right, shrank := treapDelete(n.right, key)
+		if !shrank {
+			return n, false
+		}
+		return &treapNode{key: n.key, val: n.val, priority: n.priority, left: n.left, right: right}, true
+	}
+}
+
+// treapMerge joins two persistent treaps, l and r, where every key in
+// l is less than every key in r, maintaining the heap property on
+// priority.
+func treapMerge(l, r *treapNode) *treapNode {
+	switch {
+	case l == nil:
+		return r
+	case r == nil:
+		return l
+	case l.priority > r.priority:
+		return &treapNode{key: l.key, val: l.val, priority: l.priority, left: l.left, right: treapMerge(l.right, r)}
+	default:
+		return &treapNode{key: r.key, val: r.val, priority: r.priority, left: treapMerge(l, r.left), right: r.right}
+	}
+}
+
+// rotateRight performs a persistent right rotation of n around its
+// left child.
+func rotateRight(n *treapNode) *treapNode {
+	l := n.left
+	nn := &treapNode{key: n.key, val: n.val, priority: n.priority, left: l.right, right: n.right}
+	return &treapNode{key: l.key, val: l.val, priority: l.priority, left: l.left, right: nn}
+}
+
+// rotateLeft performs a persistent left rotation of n around its
+// right child.
+func rotateLeft(n *treapNode) *treapNode {
+	r := n.right
+	nn := &treapNode{key: n.key, val: n.val, priority: n.priority, left: n.left, right: r.left}
+	return &treapNode{key: r.key, val: r.val, priority: r.priority, left: nn, right: r.right}
+}
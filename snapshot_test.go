@@ -0,0 +1,186 @@
+// Copyright 2017 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package ctmap
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	m := &Map{m: [][]byte{{0xa5, 0x5a}, {0x5a, 0xa5}}, keySize: 1, valSize: 1}
+	s := m.Snapshot()
+
+	if l := s.Len(); l != 2 {
+		t.Error("Snapshot failed")
+		t.Logf("expected len: %d", 2)
+		t.Logf("got len:      %d", l)
+		t.Fatal()
+	}
+
+	// mutating m must not affect the snapshot already taken.
+	m.Set([]byte{0xa5}, []byte{0xff})
+
+	var val [1]byte
+	if v := s.Lookup([]byte{0xa5}, val[:]); v != 1 || val[0] != 0x5a {
+		t.Error("Snapshot failed to isolate Map mutation")
+		t.Logf("expected: 0x5a, 1")
+		t.Logf("got:      0x%02x, %d", val[0], v)
+		t.Fatal()
+	}
+}
+
+func TestSnapshotDuplicateKeys(t *testing.T) {
+	// first entry for a key wins, matching Lookup, Set and Contains.
+	m := &Map{m: [][]byte{{0xa5, 0x5a}, {0xa5, 0xff}}, keySize: 1, valSize: 1}
+	s := m.Snapshot()
+
+	if l := s.Len(); l != 1 {
+		t.Error("Snapshot failed to dedupe a duplicate key")
+		t.Logf("expected len: %d", 1)
+		t.Logf("got len:      %d", l)
+		t.Fatal()
+	}
+
+	var val [1]byte
+	if v := s.Lookup([]byte{0xa5}, val[:]); v != 1 || val[0] != 0x5a {
+		t.Error("Snapshot kept the wrong entry for a duplicate key")
+		t.Logf("expected: 0x5a, 1")
+		t.Logf("got:      0x%02x, %d", val[0], v)
+		t.Fatal()
+	}
+}
+
+func TestSnapshotContains(t *testing.T) {
+	s := (&Map{m: [][]byte{{0xa5, 0x5a}, {0x5a, 0xa5}}, keySize: 1, valSize: 1}).Snapshot()
+
+	for _, c := range []struct {
+		key []byte
+		v   int
+	}{
+		{[]byte{0xa5}, 1},
+		{[]byte{0x5a}, 1},
+		{[]byte{0x11}, 0},
+	} {
+		if v := s.Contains(c.key); v != c.v {
+			t.Error("Contains failed")
+			t.Logf("expected: %d", c.v)
+			t.Logf("got:      %d", v)
+			t.Fatal()
+		}
+	}
+}
+
+func TestSnapshotWithWithout(t *testing.T) {
+	empty := (&Map{keySize: 1, valSize: 1}).Snapshot()
+
+	s1 := empty.With([]byte{0xa5}, []byte{0x11})
+	s2 := s1.With([]byte{0x5a}, []byte{0x22})
+	s3 := s2.With([]byte{0xa5}, []byte{0x33})
+
+	if l := empty.Len(); l != 0 {
+		t.Error("With mutated its receiver")
+		t.Logf("expected len: %d", 0)
+		t.Logf("got len:      %d", l)
+		t.Fatal()
+	}
+
+	for _, c := range []struct {
+		s   *Snapshot
+		len int
+	}{
+		{s1, 1},
+		{s2, 2},
+		{s3, 2},
+	} {
+		if l := c.s.Len(); l != c.len {
+			t.Error("With failed")
+			t.Logf("expected len: %d", c.len)
+			t.Logf("got len:      %d", l)
+			t.Fatal()
+		}
+	}
+
+	var val [1]byte
+	if v := s3.Lookup([]byte{0xa5}, val[:]); v != 1 || val[0] != 0x33 {
+		t.Error("With failed to update an existing key")
+		t.Logf("expected: 0x33, 1")
+		t.Logf("got:      0x%02x, %d", val[0], v)
+		t.Fatal()
+	}
+
+	s4 := s3.Without([]byte{0x5a})
+
+	if l := s3.Len(); l != 2 {
+		t.Error("Without mutated its receiver")
+		t.Logf("expected len: %d", 2)
+		t.Logf("got len:      %d", l)
+		t.Fatal()
+	}
+
+	if l := s4.Len(); l != 1 {
+		t.Error("Without failed")
+		t.Logf("expected len: %d", 1)
+		t.Logf("got len:      %d", l)
+		t.Fatal()
+	}
+
+	if v := s4.Contains([]byte{0x5a}); v != 0 {
+		t.Error("Without failed to remove key")
+		t.Logf("expected: %d", 0)
+		t.Logf("got:      %d", v)
+		t.Fatal()
+	}
+
+	s5 := s4.Without([]byte{0x5a})
+	if l := s5.Len(); l != 1 {
+		t.Error("Without of an absent key changed length")
+		t.Logf("expected len: %d", 1)
+		t.Logf("got len:      %d", l)
+		t.Fatal()
+	}
+}
+
+func TestSnapshotClone(t *testing.T) {
+	s := (&Map{m: [][]byte{{0xa5, 0x5a}, {0x5a, 0xa5}, {0x11, 0x22}}, keySize: 1, valSize: 1}).Snapshot()
+
+	m := s.Clone()
+
+	if m.Len() != s.Len() {
+		t.Error("Clone failed")
+		t.Logf("expected len: %d", s.Len())
+		t.Logf("got len:      %d", m.Len())
+		t.Fatal()
+	}
+
+	var got [][]byte
+	m.Range(func(key, val []byte) {
+		got = append(got, append(append([]byte(nil), key...), val...))
+	})
+
+	var want [][]byte
+	s.Range(func(key, val []byte) {
+		want = append(want, append(append([]byte(nil), key...), val...))
+	})
+
+	if !reflect.DeepEqual(got, want) {
+		t.Error("Clone produced different entries")
+		t.Logf("expected: %02x", want)
+		t.Logf("got:      %02x", got)
+		t.Fatal()
+	}
+
+	// Clone must be independent of s.
+	m.Set([]byte{0xa5}, []byte{0xff})
+
+	var val [1]byte
+	if v := s.Lookup([]byte{0xa5}, val[:]); v != 1 || val[0] != 0x5a {
+		t.Error("Clone shares storage with its Snapshot")
+		t.Logf("expected: 0x5a, 1")
+		t.Logf("got:      0x%02x, %d", val[0], v)
+		t.Fatal()
+	}
+}
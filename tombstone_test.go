@@ -0,0 +1,127 @@
+// Copyright 2017 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package ctmap
+
+import "testing"
+
+func TestSoftDelete(t *testing.T) {
+	m := NewWithTombstones(1, 1)
+	m.Add([]byte{0xa5}, []byte{0x5a})
+	m.Add([]byte{0x5a}, []byte{0xa5})
+
+	if l := m.Len(); l != 2 {
+		t.Error("Len failed before SoftDelete")
+		t.Logf("expected: %d", 2)
+		t.Logf("got:      %d", l)
+		t.Fatal()
+	}
+
+	if v := m.SoftDelete([]byte{0xa5}); v != 1 {
+		t.Error("SoftDelete failed")
+		t.Logf("expected: %d", 1)
+		t.Logf("got:      %d", v)
+		t.Fatal()
+	}
+
+	// the backing slice must not shrink: the entry is tombstoned,
+	// not removed.
+	if l := len(m.m); l != 2 {
+		t.Error("SoftDelete removed the backing entry")
+		t.Logf("expected len(m.m): %d", 2)
+		t.Logf("got len(m.m):      %d", l)
+		t.Fatal()
+	}
+
+	if l := m.Len(); l != 1 {
+		t.Error("Len failed after SoftDelete")
+		t.Logf("expected: %d", 1)
+		t.Logf("got:      %d", l)
+		t.Fatal()
+	}
+
+	if v := m.Contains([]byte{0xa5}); v != 0 {
+		t.Error("Contains failed to treat soft-deleted key as absent")
+		t.Logf("expected: %d", 0)
+		t.Logf("got:      %d", v)
+		t.Fatal()
+	}
+
+	var val [1]byte
+	if v := m.Lookup([]byte{0xa5}, val[:]); v != 0 {
+		t.Error("Lookup failed to treat soft-deleted key as absent")
+		t.Logf("expected: %d", 0)
+		t.Logf("got:      %d", v)
+		t.Fatal()
+	}
+
+	if v := m.Set([]byte{0xa5}, []byte{0xff}); v != 0 {
+		t.Error("Set resurrected a soft-deleted key")
+		t.Logf("expected: %d", 0)
+		t.Logf("got:      %d", v)
+		t.Fatal()
+	}
+
+	// re-deleting an already soft-deleted key behaves the same as
+	// deleting a key that was never present: both report 0.
+	if v1, v2 := m.SoftDelete([]byte{0xa5}), m.SoftDelete([]byte{0x99}); v1 != 0 || v2 != 0 {
+		t.Error("soft-deleted key distinguishable from absent key")
+		t.Logf("got: %d, %d", v1, v2)
+	}
+
+	var entries [][2]byte
+	m.Range(func(key, val []byte) {
+		entries = append(entries, [2]byte{key[0], val[0]})
+	})
+
+	if len(entries) != 1 || entries[0] != ([2]byte{0x5a, 0xa5}) {
+		t.Error("Range failed to skip soft-deleted entry")
+		t.Logf("got: %v", entries)
+		t.Fatal()
+	}
+}
+
+func TestSoftDeletePanicsWithoutTombstones(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("SoftDelete did not panic on a map without tombstones")
+		}
+	}()
+
+	New(1, 1).SoftDelete([]byte{0xa5})
+}
+
+func TestCompact(t *testing.T) {
+	m := NewWithTombstones(1, 1)
+	m.Add([]byte{0xa5}, []byte{0x5a})
+	m.Add([]byte{0x5a}, []byte{0xa5})
+	m.Add([]byte{0x11}, []byte{0x22})
+
+	m.SoftDelete([]byte{0xa5})
+	m.SoftDelete([]byte{0x11})
+
+	m.Compact()
+
+	if l := len(m.m); l != 1 {
+		t.Error("Compact failed to remove tombstoned entries")
+		t.Logf("expected len(m.m): %d", 1)
+		t.Logf("got len(m.m):      %d", l)
+		t.Fatal()
+	}
+
+	if l := m.Len(); l != 1 {
+		t.Error("Compact changed the count of live entries")
+		t.Logf("expected: %d", 1)
+		t.Logf("got:      %d", l)
+		t.Fatal()
+	}
+
+	if v := m.Contains([]byte{0x5a}); v != 1 {
+		t.Error("Compact removed a live entry")
+		t.Logf("expected: %d", 1)
+		t.Logf("got:      %d", v)
+		t.Fatal()
+	}
+}